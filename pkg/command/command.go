@@ -2,21 +2,60 @@ package command
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"github.com/SAP/jenkins-library/pkg/log"
 	"github.com/pkg/errors"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"time"
 )
 
+// ErrTimeout is returned by the Run* family of functions if the command did not
+// finish before the context passed to it (or the timeout set via SetTimeout) expired.
+var ErrTimeout = errors.New("command timed out")
+
+// consoleContextSize is the number of trailing output lines kept as context around a
+// ConsoleRule match.
+const consoleContextSize = 5
+
+// ConsoleRule matches a single line of console output against Pattern. Rules are evaluated
+// in the order passed to SetConsoleRules; the first rule whose Pattern matches a given line
+// wins for that line. If Stop is set, no further lines are scanned once this rule has fired.
+type ConsoleRule struct {
+	Category log.ErrorCategory
+	Pattern  *regexp.Regexp
+	Stop     bool
+}
+
+// ConsoleError captures the first ConsoleRule match encountered while scanning a Command's
+// output, together with a few lines of output leading up to it to help diagnose the failure.
+type ConsoleError struct {
+	Category log.ErrorCategory
+	Line     string
+	Context  []string
+}
+
 // Command defines the information required for executing a call to any executable
 type Command struct {
-	dir    string
-	stdout io.Writer
-	stderr io.Writer
-	env    []string
+	dir          string
+	stdout       io.Writer
+	stderr       io.Writer
+	env          []string
+	timeout      time.Duration
+	stdoutBuf    *bytes.Buffer
+	stderrBuf    *bytes.Buffer
+	consoleRules []ConsoleRule
+	consoleMu    sync.Mutex
+	consoleStop  bool
+	consoleCtx   []string
+	lastError    *ConsoleError
 }
 
 // SetDir sets the working directory for the execution
@@ -24,6 +63,13 @@ func (c *Command) SetDir(d string) {
 	c.dir = d
 }
 
+// SetTimeout sets a duration after which RunExecutable/RunShell are aborted if they have
+// not yet completed. It is a convenience wrapper around RunExecutableContext/RunShellContext
+// for callers which don't need to manage a context.Context themselves.
+func (c *Command) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
 // SetEnv sets explicit environment variables to be used for execution
 func (c *Command) SetEnv(e []string) {
 	c.env = e
@@ -39,21 +85,86 @@ func (c *Command) Stderr(stderr io.Writer) {
 	c.stderr = stderr
 }
 
+// CaptureStdout makes the Command additionally tee everything written to stdout into the
+// returned buffer, on top of still streaming it to the writer set via Stdout (or os.Stdout).
+// The buffer is safe to read once RunExecutable/RunShell has returned.
+func (c *Command) CaptureStdout() *bytes.Buffer {
+	if c.stdoutBuf == nil {
+		c.stdoutBuf = &bytes.Buffer{}
+	}
+	return c.stdoutBuf
+}
+
+// CaptureStderr is the stderr equivalent of CaptureStdout.
+func (c *Command) CaptureStderr() *bytes.Buffer {
+	if c.stderrBuf == nil {
+		c.stderrBuf = &bytes.Buffer{}
+	}
+	return c.stderrBuf
+}
+
+// SetConsoleRules configures the rules used to scan stdout/stderr while the command runs.
+// Rules are evaluated in order for every line of output; the result of the first match is
+// retrievable via LastError once the command has finished.
+func (c *Command) SetConsoleRules(rules []ConsoleRule) {
+	c.consoleRules = rules
+}
+
+// LastError returns the first ConsoleRule match recorded while scanning this Command's
+// output, or nil if none of the configured rules matched.
+func (c *Command) LastError() *ConsoleError {
+	return c.lastError
+}
+
+// Environ returns the effective, deduplicated environment that RunExecutable/RunShell
+// would pass to the subprocess, i.e. os.Environ() merged with the variables set via
+// SetEnv, plus an implicit PWD pointing at the directory set via SetDir (unless SetEnv
+// already provided one). If neither SetEnv nor SetDir was called, this is equivalent to
+// os.Environ().
+func (c *Command) Environ() []string {
+	cmd := exec.Cmd{}
+	appendEnvironment(&cmd, c.dir, c.env)
+	if len(cmd.Env) == 0 {
+		return os.Environ()
+	}
+	return cmd.Env
+}
+
 // ExecCommand defines how to execute os commands
 var ExecCommand = exec.Command
 
+// ExecCommandContext defines how to execute os commands bound to a context.Context,
+// so that the child process is killed once the context is done. The command is first
+// built via ExecCommand, so replacing ExecCommand also applies to RunExecutable/RunShell.
+var ExecCommandContext = func(ctx context.Context, name string, arg ...string) *exec.Cmd {
+	base := ExecCommand(name, arg...)
+	cmd := exec.CommandContext(ctx, base.Path)
+	cmd.Args = base.Args
+	cmd.Env = base.Env
+	cmd.Dir = base.Dir
+	return cmd
+}
+
 // RunShell runs the specified command on the shell
 func (c *Command) RunShell(shell, script string) error {
+	ctx, cancel := c.contextWithTimeout()
+	defer cancel()
+	return c.RunShellContext(ctx, shell, script)
+}
+
+// RunShellContext runs the specified command on the shell, aborting it if ctx is cancelled
+// or its deadline expires before the command has finished.
+func (c *Command) RunShellContext(ctx context.Context, shell, script string) error {
 
-	_out, _err := prepareOut(c.stdout, c.stderr)
+	c.prepareOut()
 
-	cmd := ExecCommand(shell)
+	cmd := ExecCommandContext(ctx, shell)
 
 	if len(c.dir) > 0 {
 		cmd.Dir = c.dir
 	}
 
-	appendEnvironment(cmd, c.env)
+	appendEnvironment(cmd, c.dir, c.env)
 
 	in := bytes.Buffer{}
 	in.Write([]byte(script))
@@ -61,8 +172,15 @@ func (c *Command) RunShell(shell, script string) error {
 
 	log.Entry().Infof("running shell script: %v %v", shell, script)
 
-	if err := runCmd(cmd, _out, _err); err != nil {
-		return errors.Wrapf(err, "running shell script failed with %v", shell)
+	out, errW, outScanner, errScanner := c.buildOutputWriters()
+	runErr := runCmd(cmd, out, errW)
+	flushConsoleScanners(outScanner, errScanner)
+
+	if runErr != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(ErrTimeout, "running shell script failed with %v", shell)
+		}
+		return errors.Wrapf(runErr, "running shell script failed with %v", shell)
 	}
 	return nil
 }
@@ -71,10 +189,21 @@ func (c *Command) RunShell(shell, script string) error {
 // !! While the cmd.Env is applied during command execution, it is NOT involved when the actual executable is resolved.
 //    Thus the executable needs to be on the PATH of the current process and it is not sufficient to alter the PATH on cmd.Env.
 func (c *Command) RunExecutable(executable string, params ...string) error {
+	ctx, cancel := c.contextWithTimeout()
+	defer cancel()
+	return c.RunExecutableContext(ctx, executable, params...)
+}
+
+// RunExecutableContext runs the specified executable with parameters, aborting it if ctx
+// is cancelled or its deadline expires before the command has finished. Cancellation is
+// propagated to the child process via exec.CommandContext, i.e. the process is killed.
+// !! While the cmd.Env is applied during command execution, it is NOT involved when the actual executable is resolved.
+//    Thus the executable needs to be on the PATH of the current process and it is not sufficient to alter the PATH on cmd.Env.
+func (c *Command) RunExecutableContext(ctx context.Context, executable string, params ...string) error {
 
-	_out, _err := prepareOut(c.stdout, c.stderr)
+	c.prepareOut()
 
-	cmd := ExecCommand(executable, params...)
+	cmd := ExecCommandContext(ctx, executable, params...)
 
 	if len(c.dir) > 0 {
 		cmd.Dir = c.dir
@@ -82,10 +211,17 @@ func (c *Command) RunExecutable(executable string, params ...string) error {
 
 	log.Entry().Infof("running command: %v %v", executable, strings.Join(params, (" ")))
 
-	appendEnvironment(cmd, c.env)
+	appendEnvironment(cmd, c.dir, c.env)
 
-	if err := runCmd(cmd, _out, _err); err != nil {
-		return errors.Wrapf(err, "running command '%v' failed", executable)
+	out, errW, outScanner, errScanner := c.buildOutputWriters()
+	runErr := runCmd(cmd, out, errW)
+	flushConsoleScanners(outScanner, errScanner)
+
+	if runErr != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.Wrapf(ErrTimeout, "running command '%v' failed", executable)
+		}
+		return errors.Wrapf(runErr, "running command '%v' failed", executable)
 	}
 	return nil
 }
@@ -95,7 +231,7 @@ func (c *Command) RunExecutable(executable string, params ...string) error {
 //    Thus the executable needs to be on the PATH of the current process and it is not sufficient to alter the PATH on cmd.Env.
 func (c *Command) RunExecutableInBackground(executable string, params ...string) (Execution, error) {
 
-	_out, _err := prepareOut(c.stdout, c.stderr)
+	c.prepareOut()
 
 	cmd := ExecCommand(executable, params...)
 
@@ -105,9 +241,15 @@ func (c *Command) RunExecutableInBackground(executable string, params ...string)
 
 	log.Entry().Infof("running command: %v %v", executable, strings.Join(params, (" ")))
 
-	appendEnvironment(cmd, c.env)
+	appendEnvironment(cmd, c.dir, c.env)
 
-	execution, err := startCmd(cmd, _out, _err)
+	// Note: since this starts the command non-blocking, any console-rule scanner wrapped
+	// around stdout/stderr here is never flushed, so a final unterminated line written right
+	// before the process exits may be missed. There is no hook available to flush once the
+	// background execution completes.
+	out, errW, _, _ := c.buildOutputWriters()
+
+	execution, err := startCmd(cmd, out, errW)
 
 	if err != nil {
 		return nil, errors.Wrapf(err, "starting command '%v' failed", executable)
@@ -116,7 +258,19 @@ func (c *Command) RunExecutableInBackground(executable string, params ...string)
 	return execution, nil
 }
 
-func appendEnvironment(cmd *exec.Cmd, env []string) {
+// contextWithTimeout returns a context bound to c.timeout (if set via SetTimeout) along
+// with its cancel function. Callers must always invoke the returned cancel function to
+// release the context's resources, even when no timeout is configured.
+func (c *Command) contextWithTimeout() (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(context.Background(), c.timeout)
+	}
+	return context.Background(), func() {}
+}
+
+func appendEnvironment(cmd *exec.Cmd, dir string, env []string) {
+
+	env = withPWD(dir, env)
 
 	if len(env) > 0 {
 
@@ -141,6 +295,65 @@ func appendEnvironment(cmd *exec.Cmd, env []string) {
 		}
 		cmd.Env = append(cmd.Env, env...)
 	}
+
+	if len(cmd.Env) > 0 {
+		cmd.Env = dedupEnv(cmd.Env)
+	}
+}
+
+// withPWD returns env with a PWD variable appended pointing at the absolute path of dir,
+// unless dir is empty or env already contains an explicit PWD. This keeps tools that read
+// PWD instead of calling getcwd (make, node, some maven plugins) in sync with cmd.Dir. A
+// relative dir is resolved against the current process' working directory.
+func withPWD(dir string, env []string) []string {
+	if len(dir) == 0 {
+		return env
+	}
+
+	for _, e := range env {
+		if strings.HasPrefix(e, "PWD=") {
+			return env
+		}
+	}
+
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return env
+	}
+
+	return append(env, "PWD="+abs)
+}
+
+// dedupEnv returns env with duplicate keys folded, keeping the last value for each key -
+// the same semantics os/exec itself applies when starting the subprocess. Comparison is
+// case-insensitive on Windows and case-sensitive everywhere else. Entries that don't
+// contain an "=", as well as Windows' special leading-"=" variables (e.g. "=C:=C:\\foo"),
+// are left untouched since they aren't ordinary key/value pairs.
+func dedupEnv(env []string) []string {
+	out := make([]string, 0, len(env))
+	indexByKey := map[string]int{}
+
+	for _, kv := range env {
+		eq := strings.Index(kv, "=")
+		if eq < 1 {
+			out = append(out, kv)
+			continue
+		}
+
+		key := kv[:eq]
+		if runtime.GOOS == "windows" {
+			key = strings.ToLower(key)
+		}
+
+		if i, ok := indexByKey[key]; ok {
+			out[i] = kv
+			continue
+		}
+		indexByKey[key] = len(out)
+		out = append(out, kv)
+	}
+
+	return out
 }
 
 func startCmd(cmd *exec.Cmd, _out, _err io.Writer) (*execution, error) {
@@ -192,20 +405,136 @@ func runCmd(cmd *exec.Cmd, _out, _err io.Writer) error {
 	return nil
 }
 
-func prepareOut(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+// prepareOut defaults c.stdout/c.stderr to os.Stdout/os.Stderr if unset.
+func (c *Command) prepareOut() {
 
-	//ToDo: check use of multiwriter instead to always write into os.Stdout and os.Stdin?
-	//stdout := io.MultiWriter(os.Stdout, &stdoutBuf)
-	//stderr := io.MultiWriter(os.Stderr, &stderrBuf)
+	if c.stdout == nil {
+		c.stdout = os.Stdout
+	}
+	if c.stderr == nil {
+		c.stderr = os.Stderr
+	}
+}
+
+// buildOutputWriters returns the writers that should actually be passed to the subprocess
+// for this invocation: c.stdout/c.stderr teed into any buffers requested via
+// CaptureStdout/CaptureStderr and, if SetConsoleRules was used, wrapped in a fresh pair of
+// consoleRuleWriters that scan each line. The writers are built locally rather than stored
+// back onto c.stdout/c.stderr, so running the same Command more than once doesn't nest tees
+// on top of each other. Console state (LastError, the Stop flag, the context ring buffer) is
+// reset so it reflects only this invocation. outScanner/errScanner are nil unless console
+// rules are configured; when non-nil, flushConsoleScanners must be called once the
+// subprocess has finished writing so a final line without a trailing newline is still
+// evaluated.
+func (c *Command) buildOutputWriters() (out, err io.Writer, outScanner, errScanner *consoleRuleWriter) {
+	out, err = c.stdout, c.stderr
+
+	if c.stdoutBuf != nil {
+		out = io.MultiWriter(out, c.stdoutBuf)
+	}
+	if c.stderrBuf != nil {
+		err = io.MultiWriter(err, c.stderrBuf)
+	}
 
-	if stdout == nil {
-		stdout = os.Stdout
+	if len(c.consoleRules) > 0 {
+		c.resetConsoleState()
+		outScanner = &consoleRuleWriter{out: out, cmd: c}
+		errScanner = &consoleRuleWriter{out: err, cmd: c}
+		out, err = outScanner, errScanner
 	}
-	if stderr == nil {
-		stderr = os.Stderr
+
+	return out, err, outScanner, errScanner
+}
+
+// flushConsoleScanners evaluates any remaining buffered-but-unterminated line held by each
+// scanner. Scanners are nil when console rules aren't configured for the Command.
+func flushConsoleScanners(scanners ...*consoleRuleWriter) {
+	for _, s := range scanners {
+		if s != nil {
+			s.flush()
+		}
 	}
+}
 
-	return stdout, stderr
+// resetConsoleState clears LastError, the Stop flag and the context ring buffer, so a
+// Command that is run more than once reports errors for the current run only.
+func (c *Command) resetConsoleState() {
+	c.consoleMu.Lock()
+	defer c.consoleMu.Unlock()
+	c.consoleStop = false
+	c.lastError = nil
+	c.consoleCtx = nil
+}
+
+// parseConsoleErrors evaluates line against the configured ConsoleRules, in order, and
+// records the first match as c.lastError along with a small ring buffer of the lines
+// leading up to it. Once a rule with Stop set has matched, further calls are no-ops.
+func (c *Command) parseConsoleErrors(line string) {
+	c.consoleMu.Lock()
+	defer c.consoleMu.Unlock()
+
+	if c.consoleStop {
+		return
+	}
+
+	c.consoleCtx = append(c.consoleCtx, line)
+	if len(c.consoleCtx) > consoleContextSize {
+		c.consoleCtx = c.consoleCtx[len(c.consoleCtx)-consoleContextSize:]
+	}
+
+	for _, rule := range c.consoleRules {
+		if !rule.Pattern.MatchString(line) {
+			continue
+		}
+
+		if c.lastError == nil {
+			context := make([]string, len(c.consoleCtx))
+			copy(context, c.consoleCtx)
+			c.lastError = &ConsoleError{Category: rule.Category, Line: line, Context: context}
+		}
+
+		if rule.Stop {
+			c.consoleStop = true
+		}
+		return
+	}
+}
+
+// consoleRuleWriter forwards every byte written to it unchanged to out, while additionally
+// splitting the stream into lines and feeding each completed line to cmd.parseConsoleErrors.
+type consoleRuleWriter struct {
+	out io.Writer
+	cmd *Command
+	buf bytes.Buffer
+}
+
+func (w *consoleRuleWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// incomplete line: keep it buffered until more data arrives
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.cmd.parseConsoleErrors(strings.TrimRight(line, "\r\n"))
+	}
+
+	return w.out.Write(p)
+}
+
+// flush evaluates whatever partial line is still buffered once the subprocess has finished
+// writing, so a final line without a trailing newline (e.g. the last line before a crash) is
+// still scanned against the console rules.
+func (w *consoleRuleWriter) flush() {
+	if w.buf.Len() == 0 {
+		return
+	}
+	line := w.buf.String()
+	w.buf.Reset()
+	w.cmd.parseConsoleErrors(strings.TrimRight(line, "\r\n"))
 }
 
 func cmdPipes(cmd *exec.Cmd) (io.ReadCloser, io.ReadCloser, error) {
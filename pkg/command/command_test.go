@@ -2,23 +2,49 @@ package command
 
 import (
 	"bytes"
+	"context"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/SAP/jenkins-library/pkg/log"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 )
 
+// helperCommands holds the helper-process implementations registered via
+// registerHelperCommand, keyed by the command name they stand in for.
+var helperCommands = map[string]func(args []string){}
+
+// helperCommandsUsed tracks which of helperCommands were actually exercised by a test, so
+// TestMain can flag dead helper code.
+var helperCommandsUsed = map[string]bool{}
+
+// registerHelperCommand makes fn available as the helper-process implementation for the
+// given command name. Individual _test.go files call this from their init() function.
+func registerHelperCommand(name string, fn func(args []string)) {
+	helperCommands[name] = fn
+}
+
+// helperCommand re-executes the test binary as a subprocess, with GO_COMMAND_TEST_PID set
+// so TestMain dispatches it to the helper command registered for name instead of running
+// the normal test suite.
+//
 //based on https://golang.org/src/os/exec/exec_test.go
-func helperCommand(command string, s ...string) (cmd *exec.Cmd) {
-	cs := []string{"-test.run=TestHelperProcess", "--", command}
-	cs = append(cs, s...)
+func helperCommand(name string, s ...string) (cmd *exec.Cmd) {
+	helperCommandsUsed[name] = true
+
+	cs := append([]string{"--", name}, s...)
 	cmd = exec.Command(os.Args[0], cs...)
-	cmd.Env = []string{"GO_WANT_HELPER_PROCESS=1"}
+	cmd.Env = []string{"GO_COMMAND_TEST_PID=" + strconv.Itoa(os.Getpid())}
 	return cmd
 }
 
@@ -77,9 +103,16 @@ func TestExecutableRun(t *testing.T) {
 		})
 
 		t.Run("success case - log parsing", func(t *testing.T) {
-			ex := Command{stdout: stdout, stderr: stderr, ErrorCategoryMapping: map[string][]string{"config": {"command echo"}}}
+			ex := Command{stdout: stdout, stderr: stderr}
+			ex.SetConsoleRules([]ConsoleRule{
+				{Category: log.ErrorConfiguration, Pattern: regexp.MustCompile("command echo")},
+			})
 			ex.RunExecutable("echo", []string{"foo bar", "baz"}...)
-			assert.Equal(t, log.ErrorConfiguration, log.GetErrorCategory())
+
+			lastError := ex.LastError()
+			if assert.NotNil(t, lastError) {
+				assert.Equal(t, log.ErrorConfiguration, lastError.Category)
+			}
 		})
 	})
 }
@@ -95,7 +128,7 @@ func TestEnvironmentVariables(t *testing.T) {
 	ex := Command{stdout: stdout, stderr: stderr}
 
 	// helperCommand function replaces the full environment with one single entry
-	// (GO_WANT_HELPER_PROCESS), hence there is no need for checking if the DEBUG
+	// (GO_COMMAND_TEST_PID), hence there is no need for checking if the DEBUG
 	// environment variable already exists in the set of environment variables for the
 	// current process.
 	ex.SetEnv([]string{"DEBUG=true"})
@@ -108,6 +141,125 @@ func TestEnvironmentVariables(t *testing.T) {
 	}
 }
 
+func TestRunExecutableContext(t *testing.T) {
+
+	t.Run("timeout kills the command and returns ErrTimeout", func(t *testing.T) {
+		ex := Command{stdout: ioutil.Discard, stderr: ioutil.Discard}
+		ex.SetTimeout(10 * time.Millisecond)
+
+		err := ex.RunExecutable("sleep", "5")
+
+		if errors.Cause(err) != ErrTimeout {
+			t.Errorf("expected ErrTimeout, got: %v", err)
+		}
+	})
+
+	t.Run("cancelled context aborts RunExecutableContext", func(t *testing.T) {
+		ex := Command{stdout: ioutil.Discard, stderr: ioutil.Discard}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := ex.RunExecutableContext(ctx, "sleep", "5")
+
+		if err == nil {
+			t.Errorf("expected an error for a cancelled context")
+		}
+	})
+}
+
+func TestDedupEnv(t *testing.T) {
+	t.Run("keeps last value for duplicate key", func(t *testing.T) {
+		result := dedupEnv([]string{"FOO=1", "BAR=1", "FOO=2"})
+		assert.Equal(t, []string{"FOO=2", "BAR=1"}, result)
+	})
+
+	t.Run("leaves malformed entries without '=' untouched", func(t *testing.T) {
+		result := dedupEnv([]string{"FOO=1", "NOTANASSIGNMENT"})
+		assert.Equal(t, []string{"FOO=1", "NOTANASSIGNMENT"}, result)
+	})
+
+	t.Run("leaves windows leading-'=' variables untouched", func(t *testing.T) {
+		result := dedupEnv([]string{"=C:=C:\\foo", "=C:=C:\\bar"})
+		assert.Equal(t, []string{"=C:=C:\\foo", "=C:=C:\\bar"}, result)
+	})
+}
+
+func TestCommandEnvironPWD(t *testing.T) {
+	t.Run("SetDir implicitly adds an absolute PWD", func(t *testing.T) {
+		ex := Command{}
+		ex.SetDir("testdata")
+
+		wd, err := os.Getwd()
+		assert.NoError(t, err)
+		expectedPWD := "PWD=" + filepath.Join(wd, "testdata")
+
+		assert.Contains(t, ex.Environ(), expectedPWD)
+	})
+
+	t.Run("explicit PWD in SetEnv is not overridden", func(t *testing.T) {
+		ex := Command{}
+		ex.SetDir("testdata")
+		ex.SetEnv([]string{"PWD=/already/set"})
+
+		assert.Contains(t, ex.Environ(), "PWD=/already/set")
+	})
+}
+
+func TestCommandEnviron(t *testing.T) {
+	t.Run("without SetEnv matches os.Environ", func(t *testing.T) {
+		ex := Command{}
+		assert.Equal(t, os.Environ(), ex.Environ())
+	})
+
+	t.Run("merges and dedups SetEnv on top of os.Environ", func(t *testing.T) {
+		ex := Command{}
+		ex.SetEnv([]string{"DEBUG=true"})
+
+		environ := ex.Environ()
+
+		count := 0
+		for _, e := range environ {
+			if e == "DEBUG=true" {
+				count++
+			}
+		}
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestCaptureStdoutStderr(t *testing.T) {
+
+	t.Run("captures in addition to streaming", func(t *testing.T) {
+		ExecCommand = helperCommand
+		defer func() { ExecCommand = exec.Command }()
+
+		stdout := new(bytes.Buffer)
+		stderr := new(bytes.Buffer)
+		ex := Command{stdout: stdout, stderr: stderr}
+
+		capturedOut := ex.CaptureStdout()
+		capturedErr := ex.CaptureStderr()
+
+		assert.NoError(t, ex.RunExecutable("echo", "foo bar", "baz"))
+
+		assert.Equal(t, "foo bar baz\n", stdout.String())
+		assert.Equal(t, "foo bar baz\n", capturedOut.String())
+
+		assert.Equal(t, "Stderr: command echo\n", stderr.String())
+		assert.Equal(t, "Stderr: command echo\n", capturedErr.String())
+	})
+
+	t.Run("repeated calls return the same buffer", func(t *testing.T) {
+		ex := Command{}
+		if ex.CaptureStdout() != ex.CaptureStdout() {
+			t.Errorf("expected CaptureStdout to return the same buffer across calls")
+		}
+		if ex.CaptureStderr() != ex.CaptureStderr() {
+			t.Errorf("expected CaptureStderr to return the same buffer across calls")
+		}
+	})
+}
+
 func TestPrepareOut(t *testing.T) {
 
 	t.Run("os", func(t *testing.T) {
@@ -148,26 +300,39 @@ func TestPrepareOut(t *testing.T) {
 }
 
 func TestParseConsoleErrors(t *testing.T) {
-	cmd := Command{
-		ErrorCategoryMapping: map[string][]string{
-			"config": {"configuration error 1", "configuration error 2"},
-			"build":  {"build failed"},
-		},
-	}
+	t.Run("records the first match, not the last", func(t *testing.T) {
+		cmd := Command{}
+		cmd.SetConsoleRules([]ConsoleRule{
+			{Category: log.ErrorConfiguration, Pattern: regexp.MustCompile("configuration error")},
+			{Category: log.ErrorBuild, Pattern: regexp.MustCompile("build failed")},
+		})
 
-	tt := []struct {
-		consoleLine      string
-		expectedCategory log.ErrorCategory
-	}{
-		{consoleLine: "this is an error", expectedCategory: log.ErrorUndefined},
-		{consoleLine: "this is configuration error 2", expectedCategory: log.ErrorConfiguration},
-		{consoleLine: "the build failed", expectedCategory: log.ErrorBuild},
-	}
+		cmd.parseConsoleErrors("this is an error")
+		cmd.parseConsoleErrors("this is a configuration error")
+		cmd.parseConsoleErrors("the build failed")
 
-	for _, test := range tt {
-		cmd.parseConsoleErrors(test.consoleLine)
-		assert.Equal(t, test.expectedCategory, log.GetErrorCategory(), test.consoleLine)
-	}
+		lastError := cmd.LastError()
+		if assert.NotNil(t, lastError) {
+			assert.Equal(t, log.ErrorConfiguration, lastError.Category)
+			assert.Equal(t, "this is a configuration error", lastError.Line)
+			assert.Equal(t, []string{"this is an error", "this is a configuration error"}, lastError.Context)
+		}
+	})
+
+	t.Run("Stop prevents further matches from being scanned", func(t *testing.T) {
+		cmd := Command{}
+		cmd.SetConsoleRules([]ConsoleRule{
+			{Category: log.ErrorConfiguration, Pattern: regexp.MustCompile("configuration error"), Stop: true},
+			{Category: log.ErrorBuild, Pattern: regexp.MustCompile("build failed")},
+		})
+
+		cmd.parseConsoleErrors("this is a configuration error")
+		cmd.parseConsoleErrors("the build failed")
+
+		assert.Equal(t, log.ErrorConfiguration, cmd.LastError().Category)
+		// the second line was never scanned, so it did not enter the context ring buffer
+		assert.Equal(t, []string{"this is a configuration error"}, cmd.consoleCtx)
+	})
 }
 
 func TestCmdPipes(t *testing.T) {
@@ -196,13 +361,63 @@ func TestCmdPipes(t *testing.T) {
 	})
 }
 
+func init() {
+	registerHelperCommand("/bin/bash", helperProcessBash)
+	registerHelperCommand("echo", helperProcessEcho)
+	registerHelperCommand("env", helperProcessEnv)
+}
+
 //based on https://golang.org/src/os/exec/exec_test.go
-//this is not directly executed
-func TestHelperProcess(*testing.T) {
+func helperProcessBash(args []string) {
+	o, _ := ioutil.ReadAll(os.Stdin)
+	fmt.Fprintf(os.Stdout, "Stdout: command /bin/bash - Stdin: %v\n", string(o))
+	fmt.Fprintf(os.Stderr, "Stderr: command /bin/bash\n")
+}
+
+func helperProcessEcho(args []string) {
+	iargs := []interface{}{}
+	for _, s := range args {
+		iargs = append(iargs, s)
+	}
+	fmt.Println(iargs...)
+	fmt.Fprintf(os.Stderr, "Stderr: command echo\n")
+}
+
+func helperProcessEnv(args []string) {
+	for _, e := range os.Environ() {
+		fmt.Println(e)
+	}
+}
 
-	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+// TestMain either dispatches to the helper command requested via helperCommand (when
+// GO_COMMAND_TEST_PID is set, i.e. this binary was re-exec'd as a subprocess), or runs the
+// normal test suite and afterwards fails if any registered helper command was never
+// exercised, so dead helper code is caught. The exhaustiveness check only enforces on a full,
+// unfiltered run: a focused invocation via -run (or -short) only ever exercises a subset of
+// the suite by design, so a gap there doesn't mean the helper is actually unused.
+func TestMain(m *testing.M) {
+	if os.Getenv("GO_COMMAND_TEST_PID") != "" {
+		runHelperCommand()
 		return
 	}
+
+	code := m.Run()
+
+	if runFlag := flag.Lookup("test.run"); (runFlag == nil || runFlag.Value.String() == "") && !testing.Short() {
+		for name := range helperCommands {
+			if !helperCommandsUsed[name] {
+				fmt.Fprintf(os.Stderr, "helper command %q was registered but never exercised by a test\n", name)
+				if code == 0 {
+					code = 1
+				}
+			}
+		}
+	}
+
+	os.Exit(code)
+}
+
+func runHelperCommand() {
 	defer os.Exit(0)
 
 	args := os.Args
@@ -218,26 +433,12 @@ func TestHelperProcess(*testing.T) {
 		os.Exit(2)
 	}
 
-	cmd, args := args[0], args[1:]
-	switch cmd {
-	case "/bin/bash":
-		o, _ := ioutil.ReadAll(os.Stdin)
-		fmt.Fprintf(os.Stdout, "Stdout: command %v - Stdin: %v\n", cmd, string(o))
-		fmt.Fprintf(os.Stderr, "Stderr: command %v\n", cmd)
-	case "echo":
-		iargs := []interface{}{}
-		for _, s := range args {
-			iargs = append(iargs, s)
-		}
-		fmt.Println(iargs...)
-		fmt.Fprintf(os.Stderr, "Stderr: command %v\n", cmd)
-	case "env":
-		for _, e := range os.Environ() {
-			fmt.Println(e)
-		}
-	default:
-		fmt.Fprintf(os.Stderr, "Unknown command %q\n", cmd)
+	name, args := args[0], args[1:]
+	fn, ok := helperCommands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n", name)
 		os.Exit(2)
-
 	}
+
+	fn(args)
 }